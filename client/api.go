@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// APIConfig configures the runtime management HTTP API.
+type APIConfig struct {
+	Addr  string `yaml:"addr"`  // defaults to 127.0.0.1:9999
+	Token string `yaml:"token"` // bearer token required on every request; empty disables auth
+}
+
+// API is a small REST/JSON control plane for inspecting and mutating
+// HostFilter rules and checker state without restarting the client.
+type API struct {
+	cfg    APIConfig
+	filter *HostFilter
+}
+
+// NewAPI news a management API bound to cfg.Addr (127.0.0.1:9999 if unset).
+func NewAPI(cfg APIConfig, filter *HostFilter) *API {
+	if cfg.Addr == "" {
+		cfg.Addr = "127.0.0.1:9999"
+	}
+	return &API{cfg: cfg, filter: filter}
+}
+
+// ListenAndServe starts the control plane. It blocks; run it in a
+// goroutine.
+func (a *API) ListenAndServe() error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/rules", a.handleRules)
+	mux.HandleFunc("/rules/", a.handleRuleByHost)
+	mux.HandleFunc("/check", a.handleCheck)
+	mux.HandleFunc("/auto/flush", a.handleAutoFlush)
+	mux.HandleFunc("/metrics", a.handleMetrics)
+
+	tslog.Green("* Management API listening on %s", a.cfg.Addr)
+	return http.ListenAndServe(a.cfg.Addr, a.withAuth(mux))
+}
+
+func (a *API) withAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.cfg.Token != "" && r.Header.Get("Authorization") != "Bearer "+a.cfg.Token {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ruleDTO is the wire representation of one rule, used by GET/POST /rules.
+type ruleDTO struct {
+	Host string `json:"host"`
+	Type string `json:"type"`
+	Port int    `json:"port"`
+}
+
+func (a *API) handleRules(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		hosts := a.filter.Rules()
+		cidrs := a.filter.CIDRRules()
+		out := make([]ruleDTO, 0, len(hosts)+len(cidrs))
+		for host, entry := range hosts {
+			out = append(out, ruleDTO{Host: host, Type: entry.Type.String(), Port: entry.Port})
+		}
+		for cidr, entry := range cidrs {
+			out = append(out, ruleDTO{Host: cidr, Type: entry.Type.String(), Port: entry.Port})
+		}
+		sort.Slice(out, func(i, j int) bool { return out[i].Host < out[j].Host })
+		writeJSON(w, out)
+
+	case http.MethodPost:
+		var dto ruleDTO
+		if err := json.NewDecoder(r.Body).Decode(&dto); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ptype := ProxyTypeFromString(dto.Type)
+		if ptype == proxyTypeNone {
+			http.Error(w, "invalid type", http.StatusBadRequest)
+			return
+		}
+		a.filter.AddHost(strings.ToLower(dto.Host), dto.Port, ptype)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleRuleByHost serves DELETE /rules/{host} and POST /rules/reload.
+func (a *API) handleRuleByHost(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/rules/")
+
+	if path == "reload" && r.Method == http.MethodPost {
+		a.filter.Init(a.filter.rulesPath)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if r.Method != http.MethodDelete || path == "" {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	a.filter.DeleteHost(strings.ToLower(path))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *API) handleCheck(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Host string `json:"host"`
+		Port int    `json:"port"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	start := time.Now()
+	ok := tcpChecker.Check(req.Host, req.Port)
+	writeJSON(w, struct {
+		OK        bool  `json:"ok"`
+		LatencyMs int64 `json:"latencyMs"`
+	}{ok, time.Since(start).Milliseconds()})
+}
+
+func (a *API) handleAutoFlush(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, struct {
+		Flushed int `json:"flushed"`
+	}{a.filter.FlushAuto()})
+}
+
+func (a *API) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	direct, proxy := a.filter.AutoRuleCount()
+	ok, fail := metrics.checks()
+
+	fmt.Fprintf(w, "taosocks_checker_total{result=\"success\"} %d\n", ok)
+	fmt.Fprintf(w, "taosocks_checker_total{result=\"failure\"} %d\n", fail)
+	fmt.Fprintf(w, "taosocks_auto_rules{type=\"direct\"} %d\n", direct)
+	fmt.Fprintf(w, "taosocks_auto_rules{type=\"proxy\"} %d\n", proxy)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
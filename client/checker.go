@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Checker decides whether a host:port is currently reachable. TCPChecker
+// and URLChecker both implement it, and callers (HostFilter) can swap
+// strategies per port via SetChecker, with SetDefaultChecker for all other
+// ports. There is no per-rule-tag checker selection.
+type Checker interface {
+	Check(host string, port int) bool
+}
+
+const latencyHistorySize = 5
+
+// latencyRing is a small fixed-size ring buffer of recent health-check
+// latencies, used to compute a median for recheck demotion decisions.
+type latencyRing struct {
+	mu      sync.Mutex
+	samples [latencyHistorySize]time.Duration
+	count   int
+	next    int
+}
+
+func (r *latencyRing) add(d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.samples[r.next] = d
+	r.next = (r.next + 1) % latencyHistorySize
+	if r.count < latencyHistorySize {
+		r.count++
+	}
+}
+
+// median returns the median of the stored samples, or 0 if there are none.
+func (r *latencyRing) median() time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.count == 0 {
+		return 0
+	}
+	sorted := append([]time.Duration(nil), r.samples[:r.count]...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[len(sorted)/2]
+}
+
+// URLChecker verifies connectivity by making an HTTP HEAD request against
+// the candidate host:port itself, through a candidate dial path (direct
+// vs. via an upstream proxy), succeeding only on a 2xx/3xx response within
+// Deadline. Unlike TCPChecker, this catches endpoints that accept the
+// TCP/TLS handshake and then hang or reset mid-stream. CanaryURL, if set,
+// is a known-reachable URL probed through the same dial path when the
+// target request fails outright, purely to tell "this host is blocked"
+// apart from "the dial path itself is down" in the log; either way the
+// check still reports failure for that host.
+type URLChecker struct {
+	CanaryURL string
+	Deadline  time.Duration
+	Dial      func(network, addr string) (net.Conn, error) // nil dials directly
+}
+
+// NewURLChecker news a URL-based checker. dial may be nil to dial the
+// target (and the canary URL) directly; pass an upstream proxy's dial func
+// to probe the proxied path instead.
+func NewURLChecker(canaryURL string, deadline time.Duration, dial func(network, addr string) (net.Conn, error)) *URLChecker {
+	return &URLChecker{CanaryURL: canaryURL, Deadline: deadline, Dial: dial}
+}
+
+// Check implements Checker.
+func (u *URLChecker) Check(host string, port int) bool {
+	_, ok := u.probe(host, port)
+	return ok
+}
+
+// CheckLatency is like Check but also returns the measured round-trip
+// latency, for callers that want to record samples (HostFilter.recheck).
+func (u *URLChecker) CheckLatency(host string, port int) (time.Duration, bool) {
+	return u.probe(host, port)
+}
+
+func (u *URLChecker) probe(host string, port int) (time.Duration, bool) {
+	dial := u.Dial
+	if dial == nil {
+		dialer := &net.Dialer{Timeout: u.Deadline}
+		dial = dialer.Dial
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{Dial: dial},
+		Timeout:   u.Deadline,
+	}
+
+	scheme := "http"
+	if port == 443 {
+		scheme = "https"
+	}
+	targetURL := fmt.Sprintf("%s://%s/", scheme, net.JoinHostPort(host, strconv.Itoa(port)))
+
+	start := time.Now()
+	resp, err := client.Head(targetURL)
+	latency := time.Since(start)
+	if err == nil {
+		defer resp.Body.Close()
+		ok := resp.StatusCode < 400
+		metrics.RecordCheck(ok)
+		return latency, ok
+	}
+
+	if u.CanaryURL != "" {
+		if canaryResp, canaryErr := client.Head(u.CanaryURL); canaryErr == nil {
+			canaryResp.Body.Close()
+			tslog.Red("? url check error: %s:%d: %s (dial path itself is reachable)", host, port, err)
+			metrics.RecordCheck(false)
+			return latency, false
+		}
+	}
+	tslog.Red("? url check error: %s:%d: %s", host, port, err)
+	metrics.RecordCheck(false)
+	return latency, false
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// dialTo redirects every dial to addr, letting tests point a URLChecker at
+// an httptest server regardless of what host:port it's asked to probe.
+func dialTo(addr string) func(network, a string) (net.Conn, error) {
+	return func(network, _ string) (net.Conn, error) {
+		return net.Dial(network, addr)
+	}
+}
+
+func TestURLCheckerProbesTargetPerHost(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer up.Close()
+
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+
+	upAddr := up.Listener.Addr().String()
+	downAddr := down.Listener.Addr().String()
+
+	upChecker := &URLChecker{Deadline: time.Second, Dial: dialTo(upAddr)}
+	if ok := upChecker.Check("example.com", 80); !ok {
+		t.Error("Check against a reachable host returned false")
+	}
+
+	downChecker := &URLChecker{Deadline: time.Second, Dial: dialTo(downAddr)}
+	if ok := downChecker.Check("example.com", 80); ok {
+		t.Error("Check against a 503 host returned true")
+	}
+}
+
+func TestURLCheckerFallsBackToCanaryOnDialFailure(t *testing.T) {
+	var canaryHits int32
+	canary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&canaryHits, 1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer canary.Close()
+	canaryAddr := canary.Listener.Addr().String()
+
+	// Dial only succeeds for the canary's address, simulating a dial path
+	// (e.g. an upstream proxy) that works in general but refuses the
+	// specific target; probe must still report failure for that target.
+	checker := &URLChecker{
+		Deadline:  time.Second,
+		CanaryURL: canary.URL,
+		Dial: func(network, addr string) (net.Conn, error) {
+			if addr == canaryAddr {
+				return net.Dial(network, addr)
+			}
+			return nil, errConnRefused{}
+		},
+	}
+	if ok := checker.Check("example.com", 443); ok {
+		t.Error("Check returned true despite the dial to the target failing")
+	}
+	if atomic.LoadInt32(&canaryHits) == 0 {
+		t.Error("canary URL was never probed after the target dial failed")
+	}
+}
+
+type errConnRefused struct{}
+
+func (errConnRefused) Error() string { return "connection refused" }
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+// GeoIPConfig configures the MaxMind GeoIP2 country database used by
+// `geoip,<code>,<action>` rules.
+type GeoIPConfig struct {
+	Path     string        `yaml:"path"`
+	URL      string        `yaml:"url"`
+	Interval time.Duration `yaml:"interval"`
+}
+
+// GeoSiteConfig configures the compiled domain-list database used by
+// `geosite,<tag>,<action>` rules.
+type GeoSiteConfig struct {
+	Path string `yaml:"path"`
+}
+
+var privateCIDRs = mustParseCIDRs(
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"127.0.0.0/8",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, c := range cidrs {
+		_, ipnet, err := net.ParseCIDR(c)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets
+}
+
+func isPrivateIP(ip net.IP) bool {
+	for _, cidr := range privateCIDRs {
+		if cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// geoipDB wraps a MaxMind GeoIP2 country database and, if configured,
+// periodically refreshes it from a URL.
+type geoipDB struct {
+	mu     sync.RWMutex
+	reader *geoip2.Reader
+	cfg    GeoIPConfig
+}
+
+// newGeoIPDB opens cfg.Path and, when cfg.URL/cfg.Interval are set, starts
+// a background auto-updater.
+func newGeoIPDB(cfg GeoIPConfig) *geoipDB {
+	db := &geoipDB{cfg: cfg}
+	db.load()
+
+	if cfg.URL != "" && cfg.Interval > 0 {
+		go db.autoUpdate()
+	}
+
+	return db
+}
+
+func (db *geoipDB) load() {
+	reader, err := geoip2.Open(db.cfg.Path)
+	if err != nil {
+		tslog.Red("geoip: failed to open %s: %s", db.cfg.Path, err)
+		return
+	}
+
+	db.mu.Lock()
+	old := db.reader
+	db.reader = reader
+	db.mu.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+}
+
+func (db *geoipDB) autoUpdate() {
+	for range time.Tick(db.cfg.Interval) {
+		if err := db.fetch(); err != nil {
+			tslog.Red("geoip: auto-update failed: %s", err)
+			continue
+		}
+		db.load()
+		tslog.Green("* geoip: database updated from %s", db.cfg.URL)
+	}
+}
+
+// fetch downloads cfg.URL and atomically replaces cfg.Path, but only once
+// the download is validated: a non-200 response is rejected before
+// anything is written, and a downloaded file geoip2 can't open is removed
+// and never swapped in, so a routine 404/5xx from the update URL can't
+// brick the on-disk database that future loads rely on.
+func (db *geoipDB) fetch() error {
+	resp, err := http.Get(db.cfg.URL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("geoip: update fetch returned %s", resp.Status)
+	}
+
+	tmp := db.cfg.Path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(file, resp.Body); err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return err
+	}
+	file.Close()
+
+	reader, err := geoip2.Open(tmp)
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("geoip: downloaded file is not a valid database: %w", err)
+	}
+	reader.Close()
+
+	return os.Rename(tmp, db.cfg.Path)
+}
+
+// country returns the ISO country code for ip, or "" if it can't be resolved.
+func (db *geoipDB) country(ip net.IP) string {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.reader == nil {
+		return ""
+	}
+	record, err := db.reader.Country(ip)
+	if err != nil {
+		return ""
+	}
+	return record.Country.IsoCode
+}
+
+type geositeMatchKind byte
+
+const (
+	geositeSuffix geositeMatchKind = iota
+	geositeKeyword
+	geositeRegex
+)
+
+type geositeEntry struct {
+	kind  geositeMatchKind
+	value string
+	re    *regexp.Regexp
+}
+
+// geositeDB is a compiled domain list indexed by tag, as referenced by
+// `geosite,<tag>,<action>` rules.
+type geositeDB struct {
+	mu   sync.RWMutex
+	tags map[string][]geositeEntry
+}
+
+// loadGeoSite parses a domain-list file where each line is
+// "tag:kind:value", kind being one of suffix/keyword/regex.
+func loadGeoSite(path string) (*geositeDB, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	db := &geositeDB{tags: make(map[string][]geositeEntry)}
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.Trim(scanner.Text(), " \t")
+		if isComment(line) || line == "" {
+			continue
+		}
+
+		toks := strings.SplitN(line, ":", 3)
+		if len(toks) != 3 {
+			tslog.Red("geosite: invalid line: %s", line)
+			continue
+		}
+
+		tag, kind, value := strings.ToLower(toks[0]), toks[1], toks[2]
+		entry := geositeEntry{value: value}
+		switch kind {
+		case "suffix":
+			entry.kind = geositeSuffix
+		case "keyword":
+			entry.kind = geositeKeyword
+		case "regex":
+			re, err := regexp.Compile(value)
+			if err != nil {
+				tslog.Red("geosite: bad regex %q: %s", value, err)
+				continue
+			}
+			entry.kind = geositeRegex
+			entry.re = re
+		default:
+			tslog.Red("geosite: unknown match kind: %s", kind)
+			continue
+		}
+
+		db.tags[tag] = append(db.tags[tag], entry)
+	}
+
+	return db, nil
+}
+
+// match reports whether host belongs to the given geosite tag.
+func (db *geositeDB) match(tag, host string) bool {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	for _, entry := range db.tags[strings.ToLower(tag)] {
+		switch entry.kind {
+		case geositeSuffix:
+			if host == entry.value || strings.HasSuffix(host, "."+entry.value) {
+				return true
+			}
+		case geositeKeyword:
+			if strings.Contains(host, entry.value) {
+				return true
+			}
+		case geositeRegex:
+			if entry.re.MatchString(host) {
+				return true
+			}
+		}
+	}
+	return false
+}
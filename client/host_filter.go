@@ -6,6 +6,7 @@ import (
 	"net"
 	"os"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -84,16 +85,6 @@ func ProxyTypeFromString(name string) ProxyType {
 	}
 }
 
-// AddrType is
-type AddrType uint
-
-// Address Types
-const (
-	_ AddrType = iota
-	IPv4
-	Domain
-)
-
 var reIsComment = regexp.MustCompile(`^[ \t]*#`)
 
 func isComment(line string) bool {
@@ -104,13 +95,105 @@ func isComment(line string) bool {
 type HostEntry struct {
 	Type ProxyType `yaml:"type"` // proxy type for this host
 	Port int       `yaml:"port"`
+
+	Latencies *latencyRing `yaml:"-"` // recent URLChecker samples, used by recheck to demote flaky hosts
+}
+
+// matcherKind enumerates the typed rule tokens a rules-file line can
+// compile to (besides the fast-pathed exact "domain" match, which lives in
+// HostFilter.hosts instead).
+type matcherKind byte
+
+const (
+	matchDomainSuffix matcherKind = iota
+	matchDomainKeyword
+	matchDomainRegex
+	matchIPCIDR
+	matchDstPort
+	matchProcessName
+	matchGeoIP
+	matchGeoSite
+)
+
+// ruleMatcher is one compiled, order-preserving line from the rules file.
+// HostFilter.test evaluates these first-match-wins, in file order.
+type ruleMatcher struct {
+	kind  matcherKind
+	ptype ProxyType
+
+	domain  string         // matchDomainSuffix / matchDomainKeyword
+	re      *regexp.Regexp // matchDomainRegex
+	ipnet   *net.IPNet     // matchIPCIDR
+	port    int            // matchDstPort
+	process string         // matchProcessName
+	geoKey  string         // matchGeoIP: ISO country code or "PRIVATE"; matchGeoSite: tag
 }
 
 // HostFilter returns the proxy type on specified host.
 type HostFilter struct {
 	mu    sync.RWMutex
-	hosts map[string]HostEntry
-	cidrs map[*net.IPNet]HostEntry
+	hosts map[string]HostEntry // exact "domain" matches and auto-generated rules; checked before rules
+	rules []ruleMatcher        // domain-suffix/keyword/regex, ip-cidr, dst-port, process-name, geoip/geosite
+
+	geoip   *geoipDB
+	geosite *geositeDB
+
+	resolver *CachingResolver
+
+	checkers         map[int]Checker
+	defaultChecker   Checker
+	latencyThreshold time.Duration
+
+	rulesPath   string
+	recheckStop chan struct{} // closed by Init to stop the previous recheck loop before starting a new one
+}
+
+// SetResolver installs the encrypted DNS resolver used to resolve domains
+// for geoip rule matching. May be nil, in which case geoip rules only
+// match already-literal IPs.
+func (f *HostFilter) SetResolver(r *CachingResolver) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.resolver = r
+}
+
+// SetChecker overrides the Checker used for a specific port, e.g. a
+// URLChecker on 443 in place of the default TCPChecker.
+func (f *HostFilter) SetChecker(port int, c Checker) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.checkers[port] = c
+}
+
+// SetDefaultChecker overrides the Checker used for ports without a
+// per-port override. Defaults to the package-level tcpChecker.
+func (f *HostFilter) SetDefaultChecker(c Checker) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.defaultChecker = c
+}
+
+// SetLatencyThreshold sets the median URLChecker latency above which
+// recheck demotes an auto-direct host back to auto-proxy.
+func (f *HostFilter) SetLatencyThreshold(d time.Duration) {
+	f.latencyThreshold = d
+}
+
+// checkerFor is called both from outside any lock (recheck) and from
+// test's deferred closure, which runs after test has already released its
+// own f.mu.RLock — so it takes its own RLock rather than
+// assuming one is held, to read f.checkers/f.defaultChecker safely
+// against concurrent SetChecker/SetDefaultChecker.
+func (f *HostFilter) checkerFor(port int) Checker {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if c, ok := f.checkers[port]; ok {
+		return c
+	}
+	if f.defaultChecker != nil {
+		return f.defaultChecker
+	}
+	return tcpChecker
 }
 
 // SaveAuto saves auto-generated rules.
@@ -156,10 +239,26 @@ func (f *HostFilter) LoadAuto(path string) {
 	}
 }
 
-// Init loads user-defined rules.
+// Init loads user-defined rules. It is safe to call again, e.g. from the
+// management API's /rules/reload, in which case it replaces the loaded
+// rules in place, leaves f.checkers/defaultChecker/latencyThreshold
+// untouched, and stops the previous recheck loop before starting a new
+// one so reloads don't leak goroutines.
 func (f *HostFilter) Init(path string) {
+	f.mu.Lock()
+
+	if f.recheckStop != nil {
+		close(f.recheckStop)
+	}
+	stop := make(chan struct{})
+	f.recheckStop = stop
+
 	f.hosts = make(map[string]HostEntry)
-	f.cidrs = make(map[*net.IPNet]HostEntry)
+	f.rules = nil
+	if f.checkers == nil {
+		f.checkers = make(map[int]Checker)
+	}
+	f.rulesPath = path
 
 	if file, err := os.Open(path); err != nil {
 		tslog.Red("rule file not found: %s", path)
@@ -168,37 +267,124 @@ func (f *HostFilter) Init(path string) {
 		file.Close()
 	}
 
-	go func() {
-		// recheck every time client restarts
-		time.Sleep(time.Second * 10)
-		f.recheck()
+	f.mu.Unlock()
 
-		// then every 12 hours do a check
-		for range time.Tick(time.Hour * 12) {
+	go f.recheckLoop(stop)
+}
+
+// recheckLoop runs recheck 10 seconds after Init and then every 12 hours,
+// until stop is closed by a later Init call.
+func (f *HostFilter) recheckLoop(stop chan struct{}) {
+	select {
+	case <-time.After(time.Second * 10): // recheck every time client restarts
+	case <-stop:
+		return
+	}
+	f.recheck()
+
+	ticker := time.NewTicker(time.Hour * 12) // then every 12 hours do a check
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
 			f.recheck()
+		case <-stop:
+			return
 		}
-	}()
+	}
+}
+
+// InitGeo loads the GeoIP2 and geosite databases used by `geoip,...` and
+// `geosite,...` rules. scanFile compiles geo rules without consulting these
+// databases; a geo rule simply never matches while its database is not
+// loaded. Call it before Init, since test reads f.geoip and f.geosite
+// without taking f.mu.
+func (f *HostFilter) InitGeo(ipCfg GeoIPConfig, siteCfg GeoSiteConfig) {
+	if ipCfg.Path != "" {
+		f.geoip = newGeoIPDB(ipCfg)
+	}
+	if siteCfg.Path != "" {
+		db, err := loadGeoSite(siteCfg.Path)
+		if err != nil {
+			tslog.Red("geosite: failed to load %s: %s", siteCfg.Path, err)
+		} else {
+			f.geosite = db
+		}
+	}
 }
 
 func (f *HostFilter) recheck() {
-	hosts := make(map[string]HostEntry)
+	promote := make(map[string]HostEntry)
+	demote := make(map[string]HostEntry)
 
 	f.mu.RLock()
 	for host, entry := range f.hosts {
-		if entry.Type == proxyTypeAutoProxy {
-			hosts[host] = entry
+		switch entry.Type {
+		case proxyTypeAutoProxy:
+			promote[host] = entry
+		case proxyTypeAutoDirect:
+			demote[host] = entry
 		}
 	}
 	f.mu.RUnlock()
 
-	for host, entry := range hosts {
+	for host, entry := range promote {
 		tslog.Green("* Rechecking %s ...", host)
-		if tcpChecker.Check(host, entry.Port) {
+		if f.checkerFor(entry.Port).Check(host, entry.Port) {
 			f.AddHost(host, entry.Port, proxyTypeAutoDirect)
 		}
 	}
+
+	if f.latencyThreshold == 0 {
+		return
+	}
+
+	for host, entry := range demote {
+		checker, ok := f.checkerFor(entry.Port).(*URLChecker)
+		if !ok {
+			continue
+		}
+
+		latency, ok := checker.CheckLatency(host, entry.Port)
+		if !ok {
+			tslog.Red("* Demoting %s: url check failed", host)
+			f.AddHost(host, entry.Port, proxyTypeAutoProxy)
+			continue
+		}
+
+		ring := f.recordLatency(host, latency)
+		if median := ring.median(); median > f.latencyThreshold {
+			tslog.Red("* Demoting %s: median latency %s exceeds threshold", host, median)
+			f.AddHost(host, entry.Port, proxyTypeAutoProxy)
+		}
+	}
 }
 
+// recordLatency appends a latency sample to host's ring buffer, creating
+// one on first use.
+func (f *HostFilter) recordLatency(host string, d time.Duration) *latencyRing {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	he := f.hosts[host]
+	if he.Latencies == nil {
+		he.Latencies = &latencyRing{}
+		f.hosts[host] = he
+	}
+	he.Latencies.add(d)
+	return he.Latencies
+}
+
+// scanFile parses the rules file into typed, order-preserving matchers:
+// `domain-suffix,youtube.com,proxy`, `domain-keyword,google,proxy`,
+// `domain-regex,^ads?\.,reject`, `ip-cidr,10.0.0.0/8,direct`,
+// `dst-port,25,reject`, `process-name,curl,direct`, `geoip,CN,direct`,
+// `geosite,tag,proxy`. For backward compatibility, an unqualified
+// `host,type` line is treated as `domain-suffix,host,type` (or
+// `ip-cidr,host,type` when host looks like a CIDR), matching every old
+// rules file's semantics: the bare entry and any of its subdomains. Use
+// the explicit `domain,host,type` form when only the exact host, not its
+// subdomains, should match.
 func (f *HostFilter) scanFile(reader io.Reader) {
 	scanner := bufio.NewScanner(reader)
 
@@ -207,31 +393,81 @@ func (f *HostFilter) scanFile(reader io.Reader) {
 		if isComment(rule) || rule == "" {
 			continue
 		}
+
 		toks := strings.Split(rule, ",")
 		if len(toks) == 2 {
-			ptype := ProxyTypeFromString(toks[1])
-			if ptype == proxyTypeNone {
-				tslog.Red("invalid proxy type: %s", toks[1])
-				continue
+			kind := "domain-suffix"
+			if strings.IndexByte(toks[0], '/') != -1 {
+				kind = "ip-cidr"
 			}
-
-			if strings.IndexByte(toks[0], '/') == -1 {
-				f.hosts[toks[0]] = HostEntry{
-					Type: ptype,
-				}
-			} else {
-				_, ipnet, err := net.ParseCIDR(toks[0])
-				if err == nil {
-					f.cidrs[ipnet] = HostEntry{
-						Type: ptype,
-					}
-				} else {
-					tslog.Red("bad cidr: %s", toks[0])
-				}
-			}
-		} else {
+			toks = []string{kind, toks[0], toks[1]}
+		}
+		if len(toks) != 3 {
 			tslog.Red("invalid rule: %s", rule)
+			continue
+		}
+
+		ptype := ProxyTypeFromString(toks[2])
+		if ptype == proxyTypeNone {
+			tslog.Red("invalid proxy type: %s", toks[2])
+			continue
+		}
+
+		f.addRule(toks[0], toks[1], ptype)
+	}
+}
+
+// addRule compiles one typed matcher. "domain" is stored in the fast-path
+// hosts map instead of the ordered rules slice.
+func (f *HostFilter) addRule(kind, value string, ptype ProxyType) {
+	switch kind {
+	case "domain":
+		f.hosts[strings.ToLower(value)] = HostEntry{Type: ptype}
+
+	case "domain-suffix":
+		f.rules = append(f.rules, ruleMatcher{kind: matchDomainSuffix, domain: strings.ToLower(value), ptype: ptype})
+
+	case "domain-keyword":
+		f.rules = append(f.rules, ruleMatcher{kind: matchDomainKeyword, domain: strings.ToLower(value), ptype: ptype})
+
+	case "domain-regex":
+		re, err := regexp.Compile(value)
+		if err != nil {
+			tslog.Red("bad regex: %s: %s", value, err)
+			return
+		}
+		f.rules = append(f.rules, ruleMatcher{kind: matchDomainRegex, re: re, ptype: ptype})
+
+	case "ip-cidr":
+		_, ipnet, err := net.ParseCIDR(value)
+		if err != nil {
+			tslog.Red("bad cidr: %s", value)
+			return
+		}
+		f.rules = append(f.rules, ruleMatcher{kind: matchIPCIDR, ipnet: ipnet, ptype: ptype})
+
+	case "dst-port":
+		port, err := strconv.Atoi(value)
+		if err != nil {
+			tslog.Red("bad port: %s", value)
+			return
+		}
+		f.rules = append(f.rules, ruleMatcher{kind: matchDstPort, port: port, ptype: ptype})
+
+	case "process-name":
+		if !processNameSupported {
+			tslog.Red("process-name rules are not supported on this platform (Linux only): %q will never match", value)
 		}
+		f.rules = append(f.rules, ruleMatcher{kind: matchProcessName, process: value, ptype: ptype})
+
+	case "geoip":
+		f.rules = append(f.rules, ruleMatcher{kind: matchGeoIP, geoKey: strings.ToUpper(value), ptype: ptype})
+
+	case "geosite":
+		f.rules = append(f.rules, ruleMatcher{kind: matchGeoSite, geoKey: value, ptype: ptype})
+
+	default:
+		tslog.Red("invalid rule: %s,%s,%s", kind, value, ptype)
 	}
 }
 
@@ -241,8 +477,9 @@ func (f *HostFilter) AddHost(host string, port int, ptype ProxyType) {
 	defer f.mu.Unlock()
 	he, ok := f.hosts[host]
 	f.hosts[host] = HostEntry{
-		Type: ptype,
-		Port: port,
+		Type:      ptype,
+		Port:      port,
+		Latencies: he.Latencies,
 	}
 	if !ok {
 		tslog.Green("+ Add Rule [%s] %s", ptype, host)
@@ -261,13 +498,104 @@ func (f *HostFilter) DeleteHost(host string) {
 	tslog.Red("- Delete Rule %s", host)
 }
 
-// Test returns proxy type for host host.
-func (f *HostFilter) Test(host string, port int) (proxyType ProxyType) {
+// Rules returns a snapshot of the exact-host rules, for the management API.
+func (f *HostFilter) Rules() map[string]HostEntry {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	out := make(map[string]HostEntry, len(f.hosts))
+	for host, entry := range f.hosts {
+		out[host] = entry
+	}
+	return out
+}
+
+// CIDRRules returns a snapshot of the ip-cidr rules keyed by CIDR string,
+// for the management API.
+func (f *HostFilter) CIDRRules() map[string]HostEntry {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	out := make(map[string]HostEntry)
+	for _, rule := range f.rules {
+		if rule.kind == matchIPCIDR {
+			out[rule.ipnet.String()] = HostEntry{Type: rule.ptype}
+		}
+	}
+	return out
+}
+
+// AutoRuleCount returns the number of auto-generated rules currently held,
+// split by direction.
+func (f *HostFilter) AutoRuleCount() (direct, proxy int) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	for _, entry := range f.hosts {
+		switch entry.Type {
+		case proxyTypeAutoDirect:
+			direct++
+		case proxyTypeAutoProxy:
+			proxy++
+		}
+	}
+	return
+}
+
+// FlushAuto removes every auto-generated rule and returns how many were
+// removed.
+func (f *HostFilter) FlushAuto() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for host, entry := range f.hosts {
+		if entry.Type.IsAuto() {
+			delete(f.hosts, host)
+			n++
+		}
+	}
+	return n
+}
+
+// TestConn is like Test, but for a CONNECT-by-IP tunnel where host carries
+// no rule-matchable information: it sniffs the TLS SNI / HTTP Host out of
+// conn, re-invokes Test against the sniffed hostname, and caches the
+// IP->hostname mapping so later connections to the same IP skip sniffing.
+// It returns the proxy type plus a conn with any peeked bytes replayed.
+func (f *HostFilter) TestConn(host string, port int, conn net.Conn) (ProxyType, net.Conn) {
+	if net.ParseIP(host) == nil {
+		return f.Test(host, port), conn
+	}
+
+	if sniffed, ok := lookupSniffedHost(host); ok {
+		return f.Test(sniffed, port), conn
+	}
+
+	sniffed, rewound, err := SniffHost(conn, port)
+	if err != nil || sniffed == "" {
+		return f.Test(host, port), rewound
+	}
+
+	cacheSniffedHost(host, sniffed)
+	return f.Test(sniffed, port), rewound
+}
+
+// Test returns proxy type for host. It is equivalent to
+// TestWithLocalAddr(host, port, nil), i.e. process-name rules never match.
+func (f *HostFilter) Test(host string, port int) ProxyType {
+	return f.test(host, port, nil)
+}
+
+// TestWithLocalAddr is like Test, but also matches process-name rules
+// against the process that owns the connection's local endpoint (Linux
+// only; local may be nil when unknown).
+func (f *HostFilter) TestWithLocalAddr(host string, port int, local *net.TCPAddr) ProxyType {
+	return f.test(host, port, local)
+}
+
+func (f *HostFilter) test(host string, port int, local *net.TCPAddr) (proxyType ProxyType) {
 	defer func() {
 		if proxyType == proxyTypeNone {
 			pty := proxyTypeAutoDirect
 			tslog.Red("? checking %s ...", host)
-			if !tcpChecker.Check(host, port) {
+			if !f.checkerFor(port).Check(host, port) {
 				pty = proxyTypeAutoProxy
 			}
 			f.AddHost(host, port, pty)
@@ -275,9 +603,6 @@ func (f *HostFilter) Test(host string, port int) (proxyType ProxyType) {
 		}
 	}()
 
-	f.mu.RLock()
-	defer f.mu.RUnlock()
-
 	host = strings.ToLower(host)
 
 	// if host is TopLevel, like localhost.
@@ -285,47 +610,92 @@ func (f *HostFilter) Test(host string, port int) (proxyType ProxyType) {
 		return proxyTypeDirect
 	}
 
-	aty := Domain
-	if net.ParseIP(host).To4() != nil {
-		aty = IPv4
+	// Snapshot everything this needs under the lock and release it before
+	// any matcher runs: matchGeoIP can call resolver.LookupIP, which on a
+	// miss blocks up to the DoH/DoT timeout, and sync.RWMutex blocks new
+	// readers once a writer (e.g. a concurrent AddHost) is queued — so
+	// holding f.mu across a slow lookup would stall every other Test,
+	// AddHost, and DeleteHost call for as long as that lookup takes.
+	f.mu.RLock()
+	he, exact := f.hosts[host]
+	rules := f.rules
+	resolver := f.resolver
+	f.mu.RUnlock()
+
+	// fast exact-domain short-circuit: literal IPs and exact "domain" /
+	// auto-generated rules both live here.
+	if exact {
+		return he.Type
 	}
 
-	if aty == IPv4 {
-		if he, ok := f.hosts[host]; ok {
-			return he.Type
+	ip := net.ParseIP(host)
+	isIP := ip != nil
+
+	// first-match-wins, in the order rules appear in the rules file.
+	for _, rule := range rules {
+		var matched bool
+		switch rule.kind {
+		case matchDomainSuffix:
+			matched = !isIP && (host == rule.domain || strings.HasSuffix(host, "."+rule.domain))
+		case matchDomainKeyword:
+			matched = !isIP && strings.Contains(host, rule.domain)
+		case matchDomainRegex:
+			matched = !isIP && rule.re.MatchString(host)
+		case matchIPCIDR:
+			matched = isIP && rule.ipnet.Contains(ip)
+		case matchDstPort:
+			matched = rule.port == port
+		case matchProcessName:
+			matched = local != nil && matchesProcess(local.Port, rule.process)
+		case matchGeoIP:
+			matched = f.matchGeoIP(resolver, host, ip, isIP, rule.geoKey)
+		case matchGeoSite:
+			matched = !isIP && f.geosite != nil && f.geosite.match(rule.geoKey, host)
 		}
-		ip := net.ParseIP(host)
-		for ipnet, he := range f.cidrs {
-			if ipnet.Contains(ip) {
-				return he.Type
-			}
+		if matched {
+			return rule.ptype
 		}
-	} else if aty == Domain {
-		// full match
-		if he, ok := f.hosts[host]; ok {
-			return he.Type
+	}
+
+	return proxyTypeNone
+}
+
+// matchGeoIP matches against `geoip,<code>,<action>` rules, including the
+// `geoip,private,<action>` shortcut for RFC1918/loopback ranges. Domains
+// are resolved through resolver first, per the optional DNS-resolution
+// step described for geoip rule matching; resolver is a snapshot taken
+// under f.mu by the caller, not read from f.resolver directly, so this
+// runs without holding the lock.
+func (f *HostFilter) matchGeoIP(resolver *CachingResolver, host string, ip net.IP, isIP bool, key string) bool {
+	ips := []net.IP{ip}
+	if !isIP {
+		if resolver == nil {
+			return false
+		}
+		resolved, err := resolver.LookupIP(host)
+		if err != nil {
+			return false
 		}
+		ips = resolved
+	}
 
-		// test suffixes (sub strings)
-		// eg. host is play.golang.org, then these suffixes will be tested:
-		//		play.golang.org
-		//		golang.org
-		//		org
-		part := host // don't modify host, it is used in defer
-		for {
-			index := strings.IndexByte(part, '.')
-			if index == -1 {
-				break
-			}
-			part = part[index+1:]
-			if he, ok := f.hosts[part]; ok {
-				// don't apply auto rules to suffix tests
-				if !he.Type.IsAuto() {
-					return he.Type
-				}
+	for _, candidate := range ips {
+		if key == "PRIVATE" {
+			if isPrivateIP(candidate) {
+				return true
 			}
+			continue
+		}
+		if f.geoip != nil && f.geoip.country(candidate) == key {
+			return true
 		}
 	}
+	return false
+}
 
-	return proxyTypeNone
+// matchesProcess reports whether the process bound to the local port has
+// the given name.
+func matchesProcess(localPort int, want string) bool {
+	name, ok := processNameForPort(localPort)
+	return ok && name == want
 }
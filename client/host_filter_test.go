@@ -0,0 +1,86 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func newTestFilter(rules string) *HostFilter {
+	f := &HostFilter{hosts: make(map[string]HostEntry)}
+	f.scanFile(strings.NewReader(rules))
+	return f
+}
+
+func TestScanFileBackwardCompatDomainMatchesSubdomains(t *testing.T) {
+	f := newTestFilter("youtube.com,proxy\n")
+
+	for _, host := range []string{"youtube.com", "www.youtube.com", "m.youtube.com"} {
+		if got := f.test(host, 443, nil); got != proxyTypeProxy {
+			t.Errorf("test(%q) = %v, want proxy", host, got)
+		}
+	}
+	if got := f.test("notyoutube.com", 443, nil); got == proxyTypeProxy {
+		t.Errorf("test(%q) = %v, want no match on unrelated domain", "notyoutube.com", got)
+	}
+}
+
+func TestScanFileBackwardCompatCIDR(t *testing.T) {
+	f := newTestFilter("10.0.0.0/8,direct\n")
+	if got := f.test("10.1.2.3", 80, nil); got != proxyTypeDirect {
+		t.Errorf("test(10.1.2.3) = %v, want direct", got)
+	}
+}
+
+func TestScanFileExplicitDomainIsExactOnly(t *testing.T) {
+	f := newTestFilter("domain,youtube.com,proxy\n")
+	if got := f.test("youtube.com", 443, nil); got != proxyTypeProxy {
+		t.Errorf("test(youtube.com) = %v, want proxy", got)
+	}
+	if got := f.test("www.youtube.com", 443, nil); got == proxyTypeProxy {
+		t.Errorf("test(www.youtube.com) = %v, want no match for explicit exact domain rule", got)
+	}
+}
+
+func TestScanFileTypedMatchers(t *testing.T) {
+	f := newTestFilter(strings.Join([]string{
+		"domain-keyword,ads,reject",
+		"domain-regex,^stat[0-9]*\\.example\\.com$,reject",
+		"dst-port,25,reject",
+	}, "\n"))
+
+	if got := f.test("ads.example.com", 80, nil); got != proxyTypeReject {
+		t.Errorf("domain-keyword: test(ads.example.com) = %v, want reject", got)
+	}
+	if got := f.test("stat1.example.com", 80, nil); got != proxyTypeReject {
+		t.Errorf("domain-regex: test(stat1.example.com) = %v, want reject", got)
+	}
+	if got := f.test("mail.example.com", 25, nil); got != proxyTypeReject {
+		t.Errorf("dst-port: test(mail.example.com:25) = %v, want reject", got)
+	}
+}
+
+func TestScanFileFirstMatchWins(t *testing.T) {
+	f := newTestFilter(strings.Join([]string{
+		"domain-suffix,example.com,direct",
+		"domain-keyword,example,proxy",
+	}, "\n"))
+
+	if got := f.test("www.example.com", 443, nil); got != proxyTypeDirect {
+		t.Errorf("test(www.example.com) = %v, want direct (first rule wins)", got)
+	}
+}
+
+func TestScanFileInvalidRuleIsSkipped(t *testing.T) {
+	f := newTestFilter(strings.Join([]string{
+		"a,b,c,d",
+		"domain-suffix,example.com,bogus-type",
+		"domain-suffix,example.org,direct",
+	}, "\n"))
+
+	if len(f.rules) != 1 {
+		t.Fatalf("expected 1 compiled rule after skipping invalid lines, got %d", len(f.rules))
+	}
+	if got := f.test("example.org", 80, nil); got != proxyTypeDirect {
+		t.Errorf("test(example.org) = %v, want direct", got)
+	}
+}
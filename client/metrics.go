@@ -0,0 +1,30 @@
+package main
+
+import (
+	"sync/atomic"
+)
+
+// metrics holds process-wide counters exposed by the management API's
+// /metrics endpoint. It only tracks what this snapshot actually wires up
+// (Checker results); a byte-counter/live-connection registry belongs here
+// once a tunnel relay loop exists to call into it, not before.
+var metrics = &Metrics{}
+
+// Metrics is a set of atomic counters; safe for concurrent use.
+type Metrics struct {
+	checkOK   int64
+	checkFail int64
+}
+
+// RecordCheck accounts one Checker.Check result.
+func (m *Metrics) RecordCheck(ok bool) {
+	if ok {
+		atomic.AddInt64(&m.checkOK, 1)
+	} else {
+		atomic.AddInt64(&m.checkFail, 1)
+	}
+}
+
+func (m *Metrics) checks() (ok, fail int64) {
+	return atomic.LoadInt64(&m.checkOK), atomic.LoadInt64(&m.checkFail)
+}
@@ -0,0 +1,104 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// processNameSupported reports whether processNameForPort can actually
+// resolve process names on this platform, so addRule can warn loudly
+// instead of silently compiling a process-name rule that will never fire.
+const processNameSupported = true
+
+// processNameForPort returns the name of the local process bound to
+// localPort, used by `process-name,<name>,<action>` rules. It walks
+// /proc/net/tcp(6) for the socket inode owning that port, then /proc/*/fd
+// for the pid holding that inode.
+func processNameForPort(localPort int) (string, bool) {
+	inode, ok := findSocketInode(localPort)
+	if !ok {
+		return "", false
+	}
+	return findProcessByInode(inode)
+}
+
+func findSocketInode(port int) (string, bool) {
+	for _, path := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		if inode, ok := scanProcNetTCP(path, port); ok {
+			return inode, true
+		}
+	}
+	return "", false
+}
+
+func scanProcNetTCP(path string, port int) (string, bool) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", false
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Scan() // header line
+
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 {
+			continue
+		}
+
+		// fields[1] is "local_address", e.g. "0100007F:1F90".
+		parts := strings.Split(fields[1], ":")
+		if len(parts) != 2 {
+			continue
+		}
+		localPort, err := strconv.ParseInt(parts[1], 16, 32)
+		if err != nil || int(localPort) != port {
+			continue
+		}
+
+		return fields[9], true // "inode" column
+	}
+	return "", false
+}
+
+func findProcessByInode(inode string) (string, bool) {
+	target := "socket:[" + inode + "]"
+
+	procs, err := os.ReadDir("/proc")
+	if err != nil {
+		return "", false
+	}
+
+	for _, proc := range procs {
+		pid, err := strconv.Atoi(proc.Name())
+		if err != nil {
+			continue
+		}
+
+		fdDir := filepath.Join("/proc", proc.Name(), "fd")
+		fds, err := os.ReadDir(fdDir)
+		if err != nil {
+			continue
+		}
+
+		for _, fd := range fds {
+			link, err := os.Readlink(filepath.Join(fdDir, fd.Name()))
+			if err != nil || link != target {
+				continue
+			}
+
+			comm, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "comm"))
+			if err != nil {
+				return "", false
+			}
+			return strings.TrimSpace(string(comm)), true
+		}
+	}
+	return "", false
+}
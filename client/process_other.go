@@ -0,0 +1,15 @@
+//go:build !linux
+
+package main
+
+// processNameSupported is false here: process-name rules are not
+// implemented on this platform and never match. addRule checks this to
+// warn at load time rather than leaving the gap silent. macOS support
+// would go through libproc, same as Clash/V2Ray's implementations.
+const processNameSupported = false
+
+// processNameForPort is only implemented on Linux (via /proc/net/tcp and
+// /proc/*/fd); on other platforms process-name rules never match.
+func processNameForPort(localPort int) (string, bool) {
+	return "", false
+}
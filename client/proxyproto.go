@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ListenerConfig configures inbound PROXY protocol handling for a listener.
+type ListenerConfig struct {
+	ProxyProtocol bool `yaml:"proxyProtocol"`
+}
+
+var proxyProtoV2Sig = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+const (
+	proxyProtoMaxV1Header = 107 // longest possible v1 header, per the spec
+	proxyProtoMaxV2Addr   = 216 // largest v2 address block (AF_UNIX); caps the pre-read regardless of family
+	proxyProtoReadTimeout = time.Second * 3
+)
+
+// proxyHeaderConn replays whatever the wrapped bufio.Reader still has
+// buffered past the PROXY header before resuming reads from conn.
+type proxyHeaderConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *proxyHeaderConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// ReadProxyHeader reads an optional HAProxy PROXY protocol v1 (text) or v2
+// (binary) header from the front of conn when listener.proxyProtocol is
+// enabled, returning the real client address it carries (nil if the header
+// declares UNKNOWN/LOCAL or none was present) and a conn with the rest of
+// the stream intact for the SOCKS/HTTP handler — and, after that, the TLS
+// SNI / HTTP Host sniffer. Header parsing strictly bounds how many bytes it
+// reads so a missing or malformed header can't stall the connection or be
+// used to smuggle bytes past the handler.
+func ReadProxyHeader(conn net.Conn) (net.Addr, net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(proxyProtoReadTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	br := bufio.NewReaderSize(conn, 512)
+	wrapped := &proxyHeaderConn{Conn: conn, r: br}
+
+	if sig, err := br.Peek(len(proxyProtoV2Sig)); err == nil && bytes.Equal(sig, proxyProtoV2Sig) {
+		addr, err := parseProxyV2(br)
+		return addr, wrapped, err
+	}
+
+	if prefix, err := br.Peek(5); err == nil && string(prefix) == "PROXY" {
+		addr, err := parseProxyV1(br)
+		return addr, wrapped, err
+	}
+
+	return nil, wrapped, nil
+}
+
+func parseProxyV1(br *bufio.Reader) (net.Addr, error) {
+	line, err := readProxyV1Line(br)
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+
+	fields := strings.Fields(line)
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, fmt.Errorf("proxyproto: malformed v1 header: %q", line)
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("proxyproto: malformed v1 header: %q", line)
+	}
+
+	srcIP := net.ParseIP(fields[2])
+	srcPort, err := strconv.Atoi(fields[4])
+	if srcIP == nil || err != nil {
+		return nil, fmt.Errorf("proxyproto: malformed v1 header: %q", line)
+	}
+	return &net.TCPAddr{IP: srcIP, Port: srcPort}, nil
+}
+
+// readProxyV1Line reads the v1 header's single text line, one byte at a
+// time, erroring out as soon as more than proxyProtoMaxV1Header bytes have
+// been read without a terminating '\n' instead of buffering an unbounded line first
+// and checking its length afterwards — a peer that never sends '\n'
+// otherwise fills memory and stalls the connection until the read
+// deadline, for every connection it opens.
+func readProxyV1Line(br *bufio.Reader) (string, error) {
+	line := make([]byte, 0, 64)
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			return "", fmt.Errorf("proxyproto: short v1 header: %w", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			return string(line), nil
+		}
+		if len(line) > proxyProtoMaxV1Header {
+			return "", fmt.Errorf("proxyproto: v1 header too long: exceeds %d bytes", proxyProtoMaxV1Header)
+		}
+	}
+}
+
+func parseProxyV2(br *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, fmt.Errorf("proxyproto: short v2 header: %w", err)
+	}
+
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("proxyproto: unsupported v2 version %d", header[12]>>4)
+	}
+	cmd := header[12] & 0x0F
+	family := header[13] >> 4
+	addrLen := binary.BigEndian.Uint16(header[14:16])
+
+	if addrLen > proxyProtoMaxV2Addr {
+		return nil, fmt.Errorf("proxyproto: v2 address block too large: %d bytes", addrLen)
+	}
+
+	body := make([]byte, addrLen)
+	if _, err := io.ReadFull(br, body); err != nil {
+		return nil, fmt.Errorf("proxyproto: short v2 address block: %w", err)
+	}
+
+	if cmd == 0x0 { // LOCAL: health check from the load balancer itself
+		return nil, nil
+	}
+
+	switch family {
+	case 0x1: // AF_INET
+		if len(body) < 12 {
+			return nil, fmt.Errorf("proxyproto: short v2 IPv4 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case 0x2: // AF_INET6
+		if len(body) < 36 {
+			return nil, fmt.Errorf("proxyproto: short v2 IPv6 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	default: // AF_UNSPEC / AF_UNIX: no routable address to report
+		return nil, nil
+	}
+}
+
+const (
+	proxyProtoV2VerCmdProxy = 0x21 // version 2, command PROXY
+	proxyProtoV2FamINET     = 0x11 // AF_INET, SOCK_STREAM
+	proxyProtoV2FamINET6    = 0x21 // AF_INET6, SOCK_STREAM
+)
+
+// WriteProxyHeaderV2 writes a binary PROXY protocol v2 header carrying src
+// and dst to w before the tunneled bytes, so a downstream service dialed
+// through an upstream proxy sees the real client origin instead of the
+// proxy's own address.
+func WriteProxyHeaderV2(w io.Writer, src, dst *net.TCPAddr) error {
+	header := make([]byte, 0, 16+36)
+	header = append(header, proxyProtoV2Sig...)
+	header = append(header, proxyProtoV2VerCmdProxy)
+
+	if srcIP, dstIP := src.IP.To4(), dst.IP.To4(); srcIP != nil && dstIP != nil {
+		body := make([]byte, 12)
+		copy(body[0:4], srcIP)
+		copy(body[4:8], dstIP)
+		binary.BigEndian.PutUint16(body[8:10], uint16(src.Port))
+		binary.BigEndian.PutUint16(body[10:12], uint16(dst.Port))
+
+		header = append(header, proxyProtoV2FamINET)
+		header = append(header, byte(len(body)>>8), byte(len(body)))
+		header = append(header, body...)
+	} else if srcIP, dstIP := src.IP.To16(), dst.IP.To16(); srcIP != nil && dstIP != nil {
+		body := make([]byte, 36)
+		copy(body[0:16], srcIP)
+		copy(body[16:32], dstIP)
+		binary.BigEndian.PutUint16(body[32:34], uint16(src.Port))
+		binary.BigEndian.PutUint16(body[34:36], uint16(dst.Port))
+
+		header = append(header, proxyProtoV2FamINET6)
+		header = append(header, byte(len(body)>>8), byte(len(body)))
+		header = append(header, body...)
+	} else {
+		return fmt.Errorf("proxyproto: unsupported address family for %s -> %s", src, dst)
+	}
+
+	_, err := w.Write(header)
+	return err
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParseProxyV1TCP4(t *testing.T) {
+	br := bufio.NewReader(strings.NewReader("PROXY TCP4 192.168.1.1 192.168.1.2 56324 443\r\n"))
+	addr, err := parseProxyV1(br)
+	if err != nil {
+		t.Fatalf("parseProxyV1: %v", err)
+	}
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok || tcpAddr.IP.String() != "192.168.1.1" || tcpAddr.Port != 56324 {
+		t.Fatalf("parseProxyV1 = %+v, want 192.168.1.1:56324", addr)
+	}
+}
+
+func TestParseProxyV1Unknown(t *testing.T) {
+	br := bufio.NewReader(strings.NewReader("PROXY UNKNOWN\r\n"))
+	addr, err := parseProxyV1(br)
+	if err != nil || addr != nil {
+		t.Fatalf("parseProxyV1(UNKNOWN) = %v, %v, want nil, nil", addr, err)
+	}
+}
+
+func TestParseProxyV1Malformed(t *testing.T) {
+	br := bufio.NewReader(strings.NewReader("PROXY TCP4 not-an-ip\r\n"))
+	if _, err := parseProxyV1(br); err == nil {
+		t.Fatal("parseProxyV1: expected error for malformed header")
+	}
+}
+
+// TestParseProxyV1UnboundedLineIsRejected guards against a peer that never
+// sends '\n': parseProxyV1 must bail out once it has read past
+// proxyProtoMaxV1Header bytes rather than buffering forever.
+func TestParseProxyV1UnboundedLineIsRejected(t *testing.T) {
+	long := "PROXY TCP4 " + strings.Repeat("1", proxyProtoMaxV1Header*2)
+	br := bufio.NewReader(strings.NewReader(long))
+	if _, err := parseProxyV1(br); err == nil {
+		t.Fatal("parseProxyV1: expected error on an overlong, unterminated line")
+	}
+}
+
+func TestParseProxyV2RoundTrip(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 12345}
+	dst := &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 443}
+
+	var buf bytes.Buffer
+	if err := WriteProxyHeaderV2(&buf, src, dst); err != nil {
+		t.Fatalf("WriteProxyHeaderV2: %v", err)
+	}
+
+	br := bufio.NewReader(&buf)
+	sig, err := br.Peek(len(proxyProtoV2Sig))
+	if err != nil || !bytes.Equal(sig, proxyProtoV2Sig) {
+		t.Fatalf("missing v2 signature: %v", err)
+	}
+
+	// parseProxyV2, like ReadProxyHeader's real call site, expects the
+	// reader positioned before the signature: its header read covers the
+	// whole 16-byte v2 fixed header, sig included.
+	addr, err := parseProxyV2(br)
+	if err != nil {
+		t.Fatalf("parseProxyV2: %v", err)
+	}
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok || !tcpAddr.IP.Equal(src.IP) || tcpAddr.Port != src.Port {
+		t.Fatalf("parseProxyV2 = %+v, want %s:%d", addr, src.IP, src.Port)
+	}
+}
+
+func TestParseProxyV2Local(t *testing.T) {
+	header := append(append([]byte{}, proxyProtoV2Sig...), 0x20, 0x00, 0x00, 0x00)
+	br := bufio.NewReader(bytes.NewReader(header))
+	addr, err := parseProxyV2(br)
+	if err != nil || addr != nil {
+		t.Fatalf("parseProxyV2(LOCAL) = %v, %v, want nil, nil", addr, err)
+	}
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// ResolverConfig configures the encrypted DNS resolver used by TCPChecker
+// and HostFilter in place of the OS resolver.
+type ResolverConfig struct {
+	Type      string        `yaml:"type"`      // "doh" or "dot"
+	URL       string        `yaml:"url"`       // DoH endpoint, e.g. https://1.1.1.1/dns-query
+	Server    string        `yaml:"server"`    // DoT host:port, e.g. 1.1.1.1:853
+	SNI       string        `yaml:"sni"`       // DoT SNI; DoH verifies against the URL's host and ignores it
+	SPKIPin   string        `yaml:"spkiPin"`   // base64 sha256 SPKI pin, pins instead of verifying the chain
+	Bootstrap []string      `yaml:"bootstrap"` // plain IPs used to dial the resolver itself, bypassing the OS resolver
+	Timeout   time.Duration `yaml:"timeout"`
+}
+
+// Resolver performs a single raw lookup, returning the TTL of the answer so
+// callers can cache it appropriately. The query asks for A records only;
+// AAAA records are returned only when a server includes them in the answer.
+type Resolver interface {
+	Resolve(name string) (ips []net.IP, ttl time.Duration, err error)
+}
+
+// NewResolver builds a Resolver from cfg, bootstrapping the DoH server's
+// own dial address from cfg.Bootstrap when given, so resolving the resolver
+// itself doesn't depend on the (possibly poisoned) OS resolver. DoT dials
+// cfg.Server as given and does not use cfg.Bootstrap.
+func NewResolver(cfg ResolverConfig) (Resolver, error) {
+	timeout := cfg.Timeout
+	if timeout == 0 {
+		timeout = time.Second * 5
+	}
+
+	switch cfg.Type {
+	case "doh":
+		return NewDoHResolver(cfg.URL, cfg.Bootstrap, timeout), nil
+	case "dot":
+		return NewDoTResolver(cfg.Server, cfg.SNI, cfg.SPKIPin, timeout), nil
+	default:
+		return nil, fmt.Errorf("resolver: unknown type: %s", cfg.Type)
+	}
+}
+
+// DoHResolver resolves names via DNS-over-HTTPS (RFC 8484), POSTing a
+// wire-format query to a configured endpoint.
+type DoHResolver struct {
+	URL     string
+	Client  *http.Client
+	Timeout time.Duration
+}
+
+// NewDoHResolver builds a DoHResolver. When bootstrap IPs are given, the
+// endpoint's own hostname is dialed directly against them instead of
+// through the OS resolver.
+func NewDoHResolver(url string, bootstrap []string, timeout time.Duration) *DoHResolver {
+	client := &http.Client{Timeout: timeout}
+	if len(bootstrap) > 0 {
+		dialer := &net.Dialer{Timeout: timeout}
+		client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				_, port, _ := net.SplitHostPort(addr)
+				return dialer.DialContext(ctx, network, net.JoinHostPort(bootstrap[0], port))
+			},
+		}
+	}
+	return &DoHResolver{URL: url, Client: client, Timeout: timeout}
+}
+
+func (d *DoHResolver) Resolve(name string) ([]net.IP, time.Duration, error) {
+	query, err := buildQuery(name)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	req, err := http.NewRequest("POST", d.URL, bytes.NewReader(query))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+	return parseAnswer(body)
+}
+
+// DoTResolver resolves names via DNS-over-TLS (RFC 7858), optionally
+// pinning the peer's SPKI hash instead of relying on chain verification.
+type DoTResolver struct {
+	Server  string // host:port, e.g. 1.1.1.1:853
+	SNI     string
+	SPKIPin string // base64 sha256 of the SubjectPublicKeyInfo
+	Timeout time.Duration
+}
+
+func NewDoTResolver(server, sni, spkiPin string, timeout time.Duration) *DoTResolver {
+	return &DoTResolver{Server: server, SNI: sni, SPKIPin: spkiPin, Timeout: timeout}
+}
+
+func (d *DoTResolver) Resolve(name string) ([]net.IP, time.Duration, error) {
+	query, err := buildQuery(name)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	cfg := &tls.Config{ServerName: d.SNI, InsecureSkipVerify: d.SPKIPin != ""}
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: d.Timeout}, "tcp", d.Server, cfg)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+
+	if d.SPKIPin != "" {
+		if err := verifySPKIPin(conn, d.SPKIPin); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	conn.SetDeadline(time.Now().Add(d.Timeout))
+
+	var length [2]byte
+	binary.BigEndian.PutUint16(length[:], uint16(len(query)))
+	if _, err := conn.Write(append(length[:], query...)); err != nil {
+		return nil, 0, err
+	}
+
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, 0, err
+	}
+	body := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, body); err != nil {
+		return nil, 0, err
+	}
+
+	return parseAnswer(body)
+}
+
+func verifySPKIPin(conn *tls.Conn, pin string) error {
+	for _, cert := range conn.ConnectionState().PeerCertificates {
+		sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		if base64.StdEncoding.EncodeToString(sum[:]) == pin {
+			return nil
+		}
+	}
+	return fmt.Errorf("resolver: no certificate matched pinned SPKI hash")
+}
+
+func buildQuery(name string) ([]byte, error) {
+	var msg dnsmessage.Message
+	msg.Header.RecursionDesired = true
+
+	n, err := dnsmessage.NewName(name + ".")
+	if err != nil {
+		return nil, err
+	}
+	msg.Questions = []dnsmessage.Question{{
+		Name:  n,
+		Type:  dnsmessage.TypeA,
+		Class: dnsmessage.ClassINET,
+	}}
+	return msg.Pack()
+}
+
+func parseAnswer(raw []byte) ([]net.IP, time.Duration, error) {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(raw); err != nil {
+		return nil, 0, err
+	}
+
+	var ips []net.IP
+	var minTTL time.Duration
+	for _, a := range msg.Answers {
+		var ip net.IP
+		switch body := a.Body.(type) {
+		case *dnsmessage.AResource:
+			ip = net.IP(body.A[:])
+		case *dnsmessage.AAAAResource:
+			ip = net.IP(body.AAAA[:])
+		default:
+			continue
+		}
+		ips = append(ips, ip)
+		if ttl := time.Duration(a.Header.TTL) * time.Second; minTTL == 0 || ttl < minTTL {
+			minTTL = ttl
+		}
+	}
+
+	if len(ips) == 0 {
+		return nil, 0, fmt.Errorf("resolver: no A/AAAA records for query")
+	}
+	if minTTL == 0 {
+		minTTL = time.Minute
+	}
+	return ips, minTTL, nil
+}
+
+type _ResolveContext struct {
+	wg  *sync.WaitGroup
+	ips []net.IP
+	err error
+}
+
+type resolveCacheEntry struct {
+	ips     []net.IP
+	expires time.Time
+}
+
+// CachingResolver caches A/AAAA answers honoring TTLs, deduplicates
+// concurrent lookups for the same name (mirroring the fan-in pattern in
+// TCPChecker.Check), and falls back to a secondary resolver when the
+// primary times out.
+type CachingResolver struct {
+	primary   Resolver
+	secondary Resolver
+	timeout   time.Duration
+
+	lock     sync.Mutex
+	cache    map[string]resolveCacheEntry
+	inflight map[string]*list.List
+}
+
+// NewCachingResolver wraps primary (falling back to secondary, which may be
+// nil) with TTL caching and fan-in deduplication.
+func NewCachingResolver(primary, secondary Resolver, timeout time.Duration) *CachingResolver {
+	return &CachingResolver{
+		primary:   primary,
+		secondary: secondary,
+		timeout:   timeout,
+		cache:     make(map[string]resolveCacheEntry),
+		inflight:  make(map[string]*list.List),
+	}
+}
+
+// LookupIP resolves name, reusing a cached answer while it is within TTL.
+func (r *CachingResolver) LookupIP(name string) ([]net.IP, error) {
+	r.lock.Lock()
+	if entry, ok := r.cache[name]; ok && time.Now().Before(entry.expires) {
+		r.lock.Unlock()
+		return entry.ips, nil
+	}
+
+	var lst *list.List
+	if l, ok := r.inflight[name]; ok {
+		lst = l
+	} else {
+		lst = list.New()
+		r.inflight[name] = lst
+		go r.lookup(name)
+	}
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	ctx := &_ResolveContext{wg: wg}
+	lst.PushBack(ctx)
+	r.lock.Unlock()
+
+	wg.Wait()
+	return ctx.ips, ctx.err
+}
+
+func (r *CachingResolver) lookup(name string) {
+	ips, ttl, err := r.resolveOne(name)
+
+	r.lock.Lock()
+	if err == nil {
+		r.cache[name] = resolveCacheEntry{ips: ips, expires: time.Now().Add(ttl)}
+	}
+	lst := r.inflight[name]
+	for lst.Len() > 0 {
+		elem := lst.Front()
+		ctx := elem.Value.(*_ResolveContext)
+		ctx.ips, ctx.err = ips, err
+		ctx.wg.Done()
+		lst.Remove(elem)
+	}
+	delete(r.inflight, name)
+	r.lock.Unlock()
+}
+
+func (r *CachingResolver) resolveOne(name string) ([]net.IP, time.Duration, error) {
+	type result struct {
+		ips []net.IP
+		ttl time.Duration
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		ips, ttl, err := r.primary.Resolve(name)
+		ch <- result{ips, ttl, err}
+	}()
+
+	select {
+	case res := <-ch:
+		if res.err == nil {
+			return res.ips, res.ttl, nil
+		}
+		tslog.Red("resolver: primary lookup failed for %s: %s", name, res.err)
+	case <-time.After(r.timeout):
+		tslog.Red("resolver: primary timed out for %s", name)
+	}
+
+	if r.secondary == nil {
+		return nil, 0, fmt.Errorf("resolver: lookup failed for %s", name)
+	}
+	return r.secondary.Resolve(name)
+}
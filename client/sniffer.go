@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	sniffTimeout = time.Second * 3
+	sniffMaxPeek = 4096
+
+	// sniffCacheTTL and sniffCacheMaxEntries bound the IP->hostname cache:
+	// CONNECT-by-IP traffic is dominated by shared/anycast infrastructure
+	// (CDNs, load balancers) where the same IP legitimately serves
+	// different domains over time, so a stale entry must expire rather
+	// than pin a rule decision forever, and the cache's size must have a
+	// ceiling regardless of TTL.
+	sniffCacheTTL        = time.Hour
+	sniffCacheMaxEntries = 4096
+)
+
+// sniffedConn replays the bytes consumed while sniffing before resuming
+// reads from the underlying connection, so a CONNECT tunnel can be handed
+// to its upstream as if nothing had been read from it.
+type sniffedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *sniffedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func newSniffedConn(conn net.Conn, peeked []byte) net.Conn {
+	if len(peeked) == 0 {
+		return conn
+	}
+	return &sniffedConn{Conn: conn, r: io.MultiReader(bytes.NewReader(peeked), conn)}
+}
+
+// SniffHost peeks at the first bytes of conn to recover the TLS SNI (port
+// 443) or HTTP Host header (port 80) of a CONNECT-by-IP tunnel, which
+// HostFilter.Test otherwise can't see. It returns the sniffed hostname
+// ("" if none could be recovered, e.g. non-TLS/HTTP traffic) and a conn
+// with the peeked bytes replayed for the caller.
+func SniffHost(conn net.Conn, port int) (string, net.Conn, error) {
+	switch port {
+	case 443:
+		return sniffTLS(conn)
+	case 80:
+		return sniffHTTP(conn)
+	default:
+		return "", conn, nil
+	}
+}
+
+func sniffTLS(conn net.Conn) (string, net.Conn, error) {
+	buf, err := peekUntil(conn, func(b []byte) bool {
+		_, _, complete := parseSNI(b)
+		return complete
+	})
+	if err != nil {
+		return "", newSniffedConn(conn, buf), err
+	}
+
+	host, _, _ := parseSNI(buf)
+	return host, newSniffedConn(conn, buf), nil
+}
+
+func sniffHTTP(conn net.Conn) (string, net.Conn, error) {
+	buf, err := peekUntil(conn, func(b []byte) bool {
+		// HTTP methods are upper-case tokens; any other first byte can't
+		// start a request, so stop peeking instead of waiting for "\r\n\r\n".
+		if b[0] < 'A' || b[0] > 'Z' {
+			return true
+		}
+		return bytes.Contains(b, []byte("\r\n\r\n"))
+	})
+	if err != nil {
+		return "", newSniffedConn(conn, buf), err
+	}
+
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(buf)))
+	if err != nil {
+		return "", newSniffedConn(conn, buf), nil
+	}
+
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return host, newSniffedConn(conn, buf), nil
+}
+
+// peekUntil reads from conn into a growing buffer until done(buf) reports
+// true, sniffMaxPeek bytes have been read, or sniffTimeout elapses; any of
+// those is treated as "stop peeking", not an error, so non-TLS/HTTP
+// traffic degrades gracefully. done must report true as soon as buf holds
+// enough to render a final verdict (match or no-match) rather than only
+// on a match, or a conclusively negative buffer stalls until sniffMaxPeek
+// or sniffTimeout for nothing.
+func peekUntil(conn net.Conn, done func([]byte) bool) ([]byte, error) {
+	conn.SetReadDeadline(time.Now().Add(sniffTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	buf := make([]byte, 0, 512)
+	tmp := make([]byte, 512)
+	for {
+		n, err := conn.Read(tmp)
+		if n > 0 {
+			buf = append(buf, tmp[:n]...)
+			if done(buf) {
+				return buf, nil
+			}
+		}
+		if err != nil {
+			return buf, nil
+		}
+		if len(buf) >= sniffMaxPeek {
+			return buf, nil
+		}
+	}
+}
+
+// parseSNI extracts the server_name extension from a TLS ClientHello
+// record. complete reports whether data held enough bytes to reach a
+// final verdict; until then found is meaningless and the caller should
+// keep peeking. Once complete is true, found (and host) are final: either
+// the ClientHello's extensions were read in full and carried no SNI, or
+// data isn't a ClientHello at all, and no amount of further peeking will
+// change that. This distinction lets sniffTLS stop as soon as it knows
+// there's nothing to learn, instead of idling until sniffTimeout on every
+// SNI-less or non-TLS connection.
+func parseSNI(data []byte) (host string, found bool, complete bool) {
+	if len(data) < 1 {
+		return "", false, false
+	}
+	if data[0] != 0x16 {
+		return "", false, true
+	}
+	if len(data) < 5 {
+		return "", false, false
+	}
+	recLen := int(binary.BigEndian.Uint16(data[3:5]))
+	if len(data) < 5+recLen {
+		return "", false, false
+	}
+	hs := data[5 : 5+recLen]
+
+	if len(hs) < 4 {
+		return "", false, true
+	}
+	if hs[0] != 0x01 {
+		return "", false, true
+	}
+	hsLen := int(hs[1])<<16 | int(hs[2])<<8 | int(hs[3])
+	if len(hs) < 4+hsLen {
+		return "", false, false
+	}
+	body := hs[4 : 4+hsLen]
+
+	pos := 2 + 32 // client_version + random
+	if len(body) < pos+1 {
+		return "", false, true
+	}
+	pos += 1 + int(body[pos]) // session_id
+	if len(body) < pos+2 {
+		return "", false, true
+	}
+	pos += 2 + int(binary.BigEndian.Uint16(body[pos:pos+2])) // cipher_suites
+	if len(body) < pos+1 {
+		return "", false, true
+	}
+	pos += 1 + int(body[pos]) // compression_methods
+	if len(body) < pos+2 {
+		return "", false, true
+	}
+	extLen := int(binary.BigEndian.Uint16(body[pos : pos+2]))
+	pos += 2
+	if len(body) < pos+extLen {
+		return "", false, true
+	}
+
+	ext := body[pos : pos+extLen]
+	for len(ext) >= 4 {
+		etype := binary.BigEndian.Uint16(ext[0:2])
+		elen := int(binary.BigEndian.Uint16(ext[2:4]))
+		if len(ext) < 4+elen {
+			return "", false, true
+		}
+		edata := ext[4 : 4+elen]
+
+		if etype == 0 { // server_name
+			if len(edata) < 2 {
+				return "", false, true
+			}
+			listLen := int(binary.BigEndian.Uint16(edata[0:2]))
+			rest := edata[2:]
+			if len(rest) < listLen {
+				return "", false, true
+			}
+			rest = rest[:listLen]
+			for len(rest) >= 3 {
+				nameType := rest[0]
+				nameLen := int(binary.BigEndian.Uint16(rest[1:3]))
+				if len(rest) < 3+nameLen {
+					return "", false, true
+				}
+				if nameType == 0 {
+					return string(rest[3 : 3+nameLen]), true, true
+				}
+				rest = rest[3+nameLen:]
+			}
+			return "", false, true
+		}
+		ext = ext[4+elen:]
+	}
+	return "", false, true
+}
+
+// sniffCacheEntry tracks both the cached hostname's expiry and its
+// position in sniffCache.order, so lookupSniffedHost can do an O(1)
+// LRU touch and cacheSniffedHost an O(1) eviction.
+type sniffCacheEntry struct {
+	host    string
+	expires time.Time
+	elem    *list.Element // holds the ip string; front = most recently used
+}
+
+var sniffCache = struct {
+	mu    sync.Mutex
+	m     map[string]*sniffCacheEntry
+	order *list.List
+}{m: make(map[string]*sniffCacheEntry), order: list.New()}
+
+// cacheSniffedHost records that ip was sniffed as host, evicting the
+// least-recently-used entry first if the cache is already at
+// sniffCacheMaxEntries.
+func cacheSniffedHost(ip, host string) {
+	sniffCache.mu.Lock()
+	defer sniffCache.mu.Unlock()
+
+	if entry, ok := sniffCache.m[ip]; ok {
+		sniffCache.order.Remove(entry.elem)
+	} else if sniffCache.order.Len() >= sniffCacheMaxEntries {
+		oldest := sniffCache.order.Back()
+		sniffCache.order.Remove(oldest)
+		delete(sniffCache.m, oldest.Value.(string))
+	}
+
+	elem := sniffCache.order.PushFront(ip)
+	sniffCache.m[ip] = &sniffCacheEntry{host: host, expires: time.Now().Add(sniffCacheTTL), elem: elem}
+}
+
+// lookupSniffedHost returns the cached hostname for ip, if any and not
+// yet expired, refreshing its LRU position on a hit.
+func lookupSniffedHost(ip string) (string, bool) {
+	sniffCache.mu.Lock()
+	defer sniffCache.mu.Unlock()
+
+	entry, ok := sniffCache.m[ip]
+	if !ok {
+		return "", false
+	}
+	if time.Now().After(entry.expires) {
+		sniffCache.order.Remove(entry.elem)
+		delete(sniffCache.m, ip)
+		return "", false
+	}
+	sniffCache.order.MoveToFront(entry.elem)
+	return entry.host, true
+}
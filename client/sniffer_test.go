@@ -0,0 +1,138 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func resetSniffCache() {
+	sniffCache.mu.Lock()
+	defer sniffCache.mu.Unlock()
+	sniffCache.m = make(map[string]*sniffCacheEntry)
+	sniffCache.order = list.New()
+}
+
+// buildClientHello assembles a minimal TLS record wrapping a ClientHello
+// handshake body, optionally carrying a server_name extension for host.
+func buildClientHello(host string) []byte {
+	var ext []byte
+	if host != "" {
+		name := []byte(host)
+		serverName := make([]byte, 0, 3+len(name))
+		serverName = append(serverName, 0x00) // name_type: host_name
+		serverName = append(serverName, byte(len(name)>>8), byte(len(name)))
+		serverName = append(serverName, name...)
+
+		list := make([]byte, 0, 2+len(serverName))
+		list = append(list, byte(len(serverName)>>8), byte(len(serverName)))
+		list = append(list, serverName...)
+
+		ext = append(ext, 0x00, 0x00) // extension type: server_name
+		ext = append(ext, byte(len(list)>>8), byte(len(list)))
+		ext = append(ext, list...)
+	}
+
+	body := make([]byte, 0, 128)
+	body = append(body, make([]byte, 2+32)...) // client_version + random
+	body = append(body, 0x00)                  // session_id len
+	body = append(body, 0x00, 0x00)            // cipher_suites len
+	body = append(body, 0x00)                  // compression_methods len
+	body = append(body, byte(len(ext)>>8), byte(len(ext)))
+	body = append(body, ext...)
+
+	hs := make([]byte, 0, 4+len(body))
+	hs = append(hs, 0x01, byte(len(body)>>16), byte(len(body)>>8), byte(len(body)))
+	hs = append(hs, body...)
+
+	record := make([]byte, 0, 5+len(hs))
+	record = append(record, 0x16, 0x03, 0x01)
+	record = append(record, byte(len(hs)>>8), byte(len(hs)))
+	record = append(record, hs...)
+	return record
+}
+
+func TestParseSNIFound(t *testing.T) {
+	data := buildClientHello("example.com")
+	host, found, complete := parseSNI(data)
+	if !complete || !found || host != "example.com" {
+		t.Fatalf("parseSNI = (%q, %v, %v), want (example.com, true, true)", host, found, complete)
+	}
+}
+
+func TestParseSNINoExtension(t *testing.T) {
+	data := buildClientHello("")
+	host, found, complete := parseSNI(data)
+	if !complete {
+		t.Fatal("parseSNI: expected complete=true for a fully-read ClientHello without SNI")
+	}
+	if found || host != "" {
+		t.Fatalf("parseSNI = (%q, %v), want not found", host, found)
+	}
+}
+
+func TestParseSNIIncomplete(t *testing.T) {
+	data := buildClientHello("example.com")
+	_, found, complete := parseSNI(data[:len(data)-5])
+	if complete {
+		t.Fatal("parseSNI: truncated ClientHello reported complete=true, want false (need more bytes)")
+	}
+	if found {
+		t.Fatal("parseSNI: truncated ClientHello reported found=true")
+	}
+}
+
+func TestParseSNINotTLS(t *testing.T) {
+	_, found, complete := parseSNI([]byte("GET / HTTP/1.1\r\n"))
+	if !complete || found {
+		t.Fatalf("parseSNI(non-TLS) = found=%v, complete=%v, want found=false, complete=true", found, complete)
+	}
+}
+
+func TestParseSNIEmptyBuffer(t *testing.T) {
+	_, found, complete := parseSNI(nil)
+	if complete || found {
+		t.Fatal("parseSNI(nil): expected complete=false, found=false while waiting for the first byte")
+	}
+}
+
+func TestSniffCacheExpires(t *testing.T) {
+	resetSniffCache()
+	defer resetSniffCache()
+
+	cacheSniffedHost("1.2.3.4", "cdn.example.com")
+	if host, ok := lookupSniffedHost("1.2.3.4"); !ok || host != "cdn.example.com" {
+		t.Fatalf("lookupSniffedHost = %q, %v, want cdn.example.com, true", host, ok)
+	}
+
+	sniffCache.mu.Lock()
+	sniffCache.m["1.2.3.4"].expires = time.Now().Add(-time.Second)
+	sniffCache.mu.Unlock()
+
+	if host, ok := lookupSniffedHost("1.2.3.4"); ok {
+		t.Fatalf("lookupSniffedHost on an expired entry = %q, true, want a miss", host)
+	}
+}
+
+func TestSniffCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	resetSniffCache()
+	defer resetSniffCache()
+
+	for i := 0; i < sniffCacheMaxEntries; i++ {
+		cacheSniffedHost(fmt.Sprintf("10.0.0.%d", i), "host")
+	}
+	// Touch the oldest entry so it's no longer the least-recently-used one.
+	if _, ok := lookupSniffedHost("10.0.0.0"); !ok {
+		t.Fatal("expected 10.0.0.0 to still be cached before the cache overflows")
+	}
+
+	cacheSniffedHost("10.0.1.0", "host") // one past the cap
+
+	if _, ok := lookupSniffedHost("10.0.0.0"); !ok {
+		t.Error("recently-touched entry was evicted; want the untouched one evicted instead")
+	}
+	if _, ok := lookupSniffedHost("10.0.0.1"); ok {
+		t.Error("expected the least-recently-used entry (10.0.0.1) to have been evicted")
+	}
+}
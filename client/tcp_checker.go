@@ -4,6 +4,7 @@ import (
 	"container/list"
 	"crypto/tls"
 	"net"
+	"strconv"
 	"sync"
 	"time"
 )
@@ -13,22 +14,49 @@ type _TcpCheckContext struct {
 	ok bool
 }
 
-// TCPChecker is a synchronous TCP connectivity checker.
+// TCPChecker is a synchronous TCP connectivity checker. It implements
+// Checker.
 type TCPChecker struct {
-	lock sync.Mutex
-	maps map[string]*list.List
+	lock     sync.Mutex
+	maps     map[string]*list.List
+	resolver *CachingResolver // optional; falls back to the OS resolver when nil
 }
 
-// NewTCPChecker news a TCP checker.
-func NewTCPChecker() *TCPChecker {
-	tc := &TCPChecker{}
+// NewTCPChecker news a TCP checker. resolver may be nil, in which case
+// net.DialTimeout's OS resolver is used as before.
+func NewTCPChecker(resolver *CachingResolver) *TCPChecker {
+	tc := &TCPChecker{resolver: resolver}
 	tc.maps = make(map[string]*list.List)
 	return tc
 }
 
-// Check returns true if a TCP connection can be correctly made.
-func (t *TCPChecker) Check(host, port string) bool {
-	hostport := net.JoinHostPort(host, port)
+// dial resolves host through the encrypted resolver (when configured)
+// before dialing, so a poisoned OS resolver can't lie about the result.
+func (t *TCPChecker) dial(hostport string) (net.Conn, error) {
+	if t.resolver == nil {
+		return net.DialTimeout("tcp4", hostport, time.Second*10)
+	}
+
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return net.DialTimeout("tcp4", hostport, time.Second*10)
+	}
+	if net.ParseIP(host) != nil {
+		return net.DialTimeout("tcp4", hostport, time.Second*10)
+	}
+
+	ips, err := t.resolver.LookupIP(host)
+	if err != nil || len(ips) == 0 {
+		tslog.Red("? resolver lookup failed for %s: %s", host, err)
+		return net.DialTimeout("tcp4", hostport, time.Second*10)
+	}
+	return net.DialTimeout("tcp4", net.JoinHostPort(ips[0].String(), port), time.Second*10)
+}
+
+// Check returns true if a TCP connection can be correctly made. It
+// implements Checker.
+func (t *TCPChecker) Check(host string, port int) bool {
+	hostport := net.JoinHostPort(host, strconv.Itoa(port))
 	t.lock.Lock()
 	var lst *list.List
 	if l, ok := t.maps[hostport]; ok {
@@ -47,13 +75,13 @@ func (t *TCPChecker) Check(host, port string) bool {
 	return ctx.ok
 }
 
-func (t *TCPChecker) check(host, port string) (ok bool) {
-	hostport := net.JoinHostPort(host, port)
+func (t *TCPChecker) check(host string, port int) (ok bool) {
+	hostport := net.JoinHostPort(host, strconv.Itoa(port))
 	defer func() {
 		t.finish(hostport, ok)
 	}()
 	switch port {
-	case "443":
+	case 443:
 		return t.checkTLS(hostport)
 	default:
 		return t.checkTCP(hostport)
@@ -61,6 +89,8 @@ func (t *TCPChecker) check(host, port string) (ok bool) {
 }
 
 func (t *TCPChecker) finish(hostport string, ok bool) {
+	metrics.RecordCheck(ok)
+
 	t.lock.Lock()
 	defer t.lock.Unlock()
 	lst := t.maps[hostport]
@@ -75,7 +105,7 @@ func (t *TCPChecker) finish(hostport string, ok bool) {
 }
 
 func (t *TCPChecker) checkTCP(hostport string) bool {
-	conn, err := net.DialTimeout("tcp4", hostport, time.Second*10)
+	conn, err := t.dial(hostport)
 	if err != nil {
 		tslog.Red("? net.DialTimeout error: %s: %s", hostport, err)
 		return false
@@ -85,7 +115,7 @@ func (t *TCPChecker) checkTCP(hostport string) bool {
 }
 
 func (t *TCPChecker) checkTLS(hostport string) bool {
-	conn, err := net.DialTimeout("tcp4", hostport, time.Second*10)
+	conn, err := t.dial(hostport)
 	if err != nil {
 		tslog.Red("? net.DialTimeout error: %s: %s", hostport, err)
 		return false